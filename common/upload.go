@@ -0,0 +1,30 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// UploadFile performs the HTTPS PUT of r to blobURI, an already-SAS-signed
+// blob storage URI (e.g. IoT Hub's file-upload SAS URI). It lives here
+// rather than in a transport package so uploading doesn't require
+// importing one just to PUT a blob.
+func UploadFile(ctx context.Context, blobURI string, r io.Reader) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, blobURI, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("blob upload failed with %d response code", res.StatusCode)
+	}
+	return nil
+}
@@ -1,10 +1,15 @@
 package mqtt
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
 	"net/url"
 	"os"
 	"strconv"
@@ -17,12 +22,60 @@ import (
 
 	"github.com/amenzhinsky/iothub/common"
 	"github.com/amenzhinsky/iothub/iotmodule/transport"
+	"github.com/amenzhinsky/iothub/iotmodule/transport/mqtt/store"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
 // DefaultQoS is the default quality of service value.
 const DefaultQoS = 1
 
+// fileUploadAPIVersion is the IoT Hub REST API version used by the
+// file-upload HTTPS calls (RequestFileUploadURI, NotifyFileUpload).
+const fileUploadAPIVersion = "2021-04-12"
+
+// TopicTemplates holds every MQTT topic this transport publishes or
+// subscribes to, so it can be run behind an on-prem broker/bridge that
+// rewrites topics, e.g. when aggregating many devices through one relay.
+// "{device}" and "{module}" placeholders are replaced with the connected
+// device and module IDs; a "%d" verb is a fmt.Sprintf placeholder filled
+// in with $rid (and, for DirectMethodResponse, the status code first).
+// DefaultTopicTemplates returns today's Azure IoT Hub values.
+type TopicTemplates struct {
+	Events               string // outbound telemetry
+	Inputs               string // inbound module-to-module message subscription
+	State                string // retained device/module state, see PublishState
+	TwinGet              string // twin GET request, %d is $rid
+	TwinPatch            string // twin PATCH (reported properties) request, %d is $rid
+	TwinUpdates          string // desired properties PATCH subscription
+	TwinResponse         string // twin GET/PATCH response subscription
+	DirectMethods        string // direct method invocation subscription
+	DirectMethodResponse string // direct method response, %d %d is status code then $rid
+}
+
+// DefaultTopicTemplates returns the topic templates this transport has
+// always used, i.e. the ones IoT Hub expects when talked to directly.
+func DefaultTopicTemplates() TopicTemplates {
+	return TopicTemplates{
+		Events:               "devices/{device}/modules/{module}/messages/events/",
+		Inputs:               "devices/{device}/modules/{module}/inputs/#",
+		State:                "devices/{device}/modules/{module}/state",
+		TwinGet:              "$iothub/twin/GET/?$rid=%d",
+		TwinPatch:            "$iothub/twin/PATCH/properties/reported/?$rid=%d",
+		TwinUpdates:          "$iothub/twin/PATCH/properties/desired/#",
+		TwinResponse:         "$iothub/twin/res/#",
+		DirectMethods:        "$iothub/methods/POST/#",
+		DirectMethodResponse: "$iothub/methods/res/%d/?$rid=%d",
+	}
+}
+
+// will holds the Last Will & Testament message configured via WithWill.
+type will struct {
+	topic    string
+	payload  []byte
+	qos      byte
+	retained bool
+}
+
 // TransportOption is a transport configuration option.
 type TransportOption func(tr *Transport)
 
@@ -34,6 +87,102 @@ func WithLogger(l logger.Logger) TransportOption {
 	}
 }
 
+// WithBrokerScheme overrides the scheme and port used to dial the broker,
+// e.g. WithBrokerScheme("wss", 443) makes the transport connect over MQTT
+// over WebSockets (TLS) instead of plain TCP+TLS, which is useful on
+// networks that only permit HTTP(S) egress. The Paho client understands
+// "tls", "tcp", "ws" and "wss" schemes.
+func WithBrokerScheme(scheme string, port int) TransportOption {
+	return func(tr *Transport) {
+		tr.brokerScheme = scheme
+		tr.brokerPort = port
+	}
+}
+
+// WithWill configures the MQTT Last Will & Testament message that the
+// broker publishes to topic on behalf of the client if it disconnects
+// ungracefully, e.g. inspired by gateway bridges that report device
+// liveness as a retained message so the broker (and downstream apps)
+// always see the last known state.
+func WithWill(topic string, payload []byte, qos byte, retained bool) TransportOption {
+	return func(tr *Transport) {
+		tr.will = &will{topic: topic, payload: payload, qos: qos, retained: retained}
+	}
+}
+
+// WithStateTopicTemplate overrides the topic PublishState publishes to.
+// "{device}" and "{module}" are replaced with the connected device and
+// module IDs. The default is "devices/{device}/modules/{module}/state".
+//
+// It's a shorthand for WithTopicTemplates for just the State field; use
+// WithTopicTemplates directly to override more than one topic.
+func WithStateTopicTemplate(tpl string) TransportOption {
+	return func(tr *Transport) {
+		tr.topics.State = tpl
+	}
+}
+
+// WithTopicTemplates overrides the full set of topics this transport
+// uses, e.g. to run behind an on-prem broker/bridge that rewrites
+// topics. Start from DefaultTopicTemplates() and change only what needs
+// to differ, since every field left empty is used as an empty topic.
+func WithTopicTemplates(t TopicTemplates) TransportOption {
+	return func(tr *Transport) {
+		tr.topics = t
+	}
+}
+
+// WithTopicPrefix prepends prefix to every topic this transport
+// publishes or subscribes to, a shortcut for relay deployments that
+// namespace all traffic under a common root instead of rewriting each
+// topic individually.
+func WithTopicPrefix(prefix string) TransportOption {
+	return func(tr *Transport) {
+		tr.topicPrefix = prefix
+	}
+}
+
+// WithTokenLifetime sets how long generated SAS tokens are valid for.
+// Defaults to one hour.
+func WithTokenLifetime(d time.Duration) TransportOption {
+	return func(tr *Transport) {
+		tr.tokenLifetime = d
+	}
+}
+
+// WithTokenRenewSkew sets how long before a cached SAS token's expiry the
+// background refresher regenerates it. Defaults to 5 minutes.
+func WithTokenRenewSkew(d time.Duration) TransportOption {
+	return func(tr *Transport) {
+		tr.tokenRenewSkew = d
+	}
+}
+
+// WithTokenRefreshJitter adds up to d of random delay before the forced
+// reconnect that follows a token renewal, so that devices across a large
+// fleet don't all reconnect to the broker at the same instant.
+func WithTokenRefreshJitter(d time.Duration) TransportOption {
+	return func(tr *Transport) {
+		tr.tokenRefreshJitter = d
+	}
+}
+
+// WithOutbox enables a durable store-and-forward outbox so Send and
+// non-retained PublishState calls don't fail hard while the connection to the broker is
+// down: the publish is persisted in s instead and flushed once the
+// connection comes back. Request/response calls (RetrieveTwinProperties,
+// UpdateTwinProperties, ...) don't use the outbox, since there's no
+// sensible way to deliver their response once queued; those still fail
+// immediately when disconnected. Only non-retained QoS 1 publishes are
+// eligible for queuing. maxBytes caps the payload size accepted into the outbox (0
+// means unbounded); larger payloads fail immediately instead of queuing.
+func WithOutbox(s store.Store, maxBytes int64) TransportOption {
+	return func(tr *Transport) {
+		tr.outbox = s
+		tr.outboxMaxBytes = maxBytes
+	}
+}
+
 // WithClientOptionsConfig configures the mqtt client options structure,
 // use it only when you know EXACTLY what you're doing, because changing
 // some of opts attributes may lead to unexpected behaviour.
@@ -52,7 +201,8 @@ func WithClientOptionsConfig(fn func(opts *mqtt.ClientOptions)) TransportOption
 // See more: https://docs.microsoft.com/en-us/azure/iot-hub/iot-hub-mqtt-support
 func New(opts ...TransportOption) transport.Transport {
 	tr := &Transport{
-		done: make(chan struct{}),
+		done:   make(chan struct{}),
+		topics: DefaultTopicTemplates(),
 	}
 	for _, opt := range opts {
 		opt(tr)
@@ -76,8 +226,38 @@ type Transport struct {
 	done chan struct{}         // closed when the transport is closed
 	resp map[uint32]chan *resp // responses from iothub
 
+	twinRespSubbed bool // whether $iothub/twin/res/# is subscribed to
+
 	logger logger.Logger
 	cocfg  func(opts *mqtt.ClientOptions)
+
+	creds      transport.Credentials // set on Connect, used by the file-upload HTTPS calls
+	httpClient *http.Client          // shared by the file-upload HTTPS calls
+
+	// fileUploadBaseURL overrides the "https://{hub}" file-upload API
+	// endpoint; empty means use creds.GetHostName(). Sized for pointing
+	// at a local emulator or test server, never set in production.
+	fileUploadBaseURL string
+
+	brokerScheme string // "tls" (default), "ws" or "wss"
+	brokerPort   int    // 0 means use the scheme's default port
+
+	will *will
+
+	topics      TopicTemplates
+	topicPrefix string
+
+	tokenLifetime      time.Duration // default time.Hour
+	tokenRenewSkew     time.Duration // default 5 * time.Minute
+	tokenRefreshJitter time.Duration
+
+	tokMu     sync.Mutex
+	tok       string
+	tokExpiry time.Time
+
+	outbox         store.Store
+	outboxMaxBytes int64
+	draining       int32 // 1 while a drainOutbox goroutine is running, CAS-guarded
 }
 
 type resp struct {
@@ -98,20 +278,7 @@ func (tr *Transport) Connect(ctx context.Context, creds transport.Credentials) e
 		return errors.New("already connected")
 	}
 
-	tlsCfg := &tls.Config{}
-
-	if creds.UseEdgeGateway() {
-		wluri := os.Getenv("IOTEDGE_WORKLOADURI")
-		apiv := os.Getenv("IOTEDGE_APIVERSION")
-		tlsCfg.RootCAs = common.TrustBundle(wluri, apiv)
-		tlsCfg.InsecureSkipVerify = true // x509: certificate signed by unknown authority if missing
-	} else {
-		tlsCfg.RootCAs = common.RootCAs()
-	}
-
-	if crt := creds.GetCertificate(); crt != nil {
-		tlsCfg.Certificates = append(tlsCfg.Certificates, *crt)
-	}
+	tlsCfg := buildTLSConfig(creds)
 
 	// https://docs.microsoft.com/en-us/azure/iot-hub/iot-hub-mqtt-support#using-the-mqtt-protocol-directly-as-a-module
 	//
@@ -127,25 +294,18 @@ func (tr *Transport) Connect(ctx context.Context, creds transport.Credentials) e
 
 	username := creds.GetHostName() + "/" + creds.GetDeviceID() + "/" + creds.GetModuleID() + "/?api-version=2018-06-30"
 	tr.logger.Warnf("mqtt username: %s", username)
+
 	o := mqtt.NewClientOptions()
 	o.SetTLSConfig(tlsCfg)
-	o.AddBroker("tls://" + creds.GetBroker() + ":8883")
+	o.AddBroker(brokerURL(tr.brokerScheme, tr.brokerPort, creds.GetBroker()))
 	o.SetClientID(creds.GetDeviceID() + "/" + creds.GetModuleID())
-	o.SetCredentialsProvider(func() (string, string) {
-		if crt := creds.GetCertificate(); crt != nil {
-			return username, ""
-		}
-		// TODO: renew token only when it expires in case an external token provider is used
-		// TODO: this can slow down the reconnect feature, so need to figure out max token lifetime
-		audience := url.QueryEscape(creds.GetHostName() + "/devices/" + creds.GetDeviceID() + "/modules/" + creds.GetModuleID())
-		sas, err := creds.Token(audience, time.Hour)
-		if err != nil {
-			tr.logger.Errorf("cannot generate token: %s", err)
-			return "", ""
-		}
-		tr.logger.Warnf("mqtt password: %s", sas.String())
-		return username, sas.String()
-	})
+	audience := url.QueryEscape(creds.GetHostName() + "/devices/" + creds.GetDeviceID() + "/modules/" + creds.GetModuleID())
+	o.SetCredentialsProvider(credentialsProvider(username, creds.GetCertificate(), tr.logger, func() (string, error) {
+		return tr.sasToken(creds, audience)
+	}))
+	if tr.will != nil {
+		o.SetWill(tr.will.topic, string(tr.will.payload), tr.will.qos, tr.will.retained)
+	}
 	o.SetWriteTimeout(30 * time.Second)
 	o.SetMaxReconnectInterval(30 * time.Second) // default is 15min, way to long
 	o.SetOnConnectHandler(func(c mqtt.Client) {
@@ -157,6 +317,12 @@ func (tr *Transport) Connect(ctx context.Context, creds transport.Credentials) e
 			}
 		}
 		tr.subm.RUnlock()
+		if tr.outbox != nil {
+			// pass the just-connected client in directly instead of
+			// reading tr.conn, which isn't assigned yet on the very
+			// first connect (this handler runs inside c.Connect()).
+			go tr.drainOutbox(c)
+		}
 	})
 	o.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
 		tr.logger.Debugf("connection lost: %v", err)
@@ -176,9 +342,193 @@ func (tr *Transport) Connect(ctx context.Context, creds transport.Credentials) e
 	tr.gid = creds.GetGenerationID()
 	tr.edgeGateway = creds.UseEdgeGateway()
 	tr.conn = c
+	tr.creds = creds
+	tr.httpClient = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg}}
+
+	if creds.GetCertificate() == nil {
+		go tr.refreshTokenLoop(creds, audience)
+	}
 	return nil
 }
 
+// buildTLSConfig returns the tls.Config used both for the MQTT
+// connection and the file-upload HTTPS calls: the appropriate root CA
+// trust (IoT Edge's trust bundle when running as an Edge module, IoT
+// Hub's public CAs otherwise) plus the client certificate, if creds
+// authenticates with one.
+func buildTLSConfig(creds transport.Credentials) *tls.Config {
+	cfg := &tls.Config{}
+	if creds.UseEdgeGateway() {
+		wluri := os.Getenv("IOTEDGE_WORKLOADURI")
+		apiv := os.Getenv("IOTEDGE_APIVERSION")
+		cfg.RootCAs = common.TrustBundle(wluri, apiv)
+		cfg.InsecureSkipVerify = true // x509: certificate signed by unknown authority if missing
+	} else {
+		cfg.RootCAs = common.RootCAs()
+	}
+	if crt := creds.GetCertificate(); crt != nil {
+		cfg.Certificates = append(cfg.Certificates, *crt)
+	}
+	return cfg
+}
+
+// brokerURL builds the URL Paho dials, applying the same defaulting
+// Connect has always used: scheme defaults to "tls" (plain MQTT+TLS,
+// what IoT Hub expects directly), and an unset port defaults to the
+// scheme's standard one (8883 for tls/tcp, 80 for ws, 443 for wss). The
+// "/mqtt" path suffix is required by Paho's websocket dialer, so it's
+// only appended for ws/wss.
+func brokerURL(scheme string, port int, host string) string {
+	if scheme == "" {
+		scheme = "tls"
+	}
+	if port == 0 {
+		switch scheme {
+		case "wss":
+			port = 443
+		case "ws":
+			port = 80
+		default:
+			port = 8883
+		}
+	}
+	u := fmt.Sprintf("%s://%s:%d", scheme, host, port)
+	if scheme == "ws" || scheme == "wss" {
+		u += "/mqtt"
+	}
+	return u
+}
+
+// credentialsProvider returns the callback passed to
+// mqtt.ClientOptions.SetCredentialsProvider. A client authenticating
+// with an X.509 certificate sends an empty password, since its identity
+// is already carried by the TLS client certificate; everything else
+// calls getToken for a SAS token to use as the password, logging and
+// falling back to an empty username and password if that fails (the broker will then
+// reject the connection with a clear auth error instead of panicking on
+// a missing credential).
+func credentialsProvider(username string, cert *tls.Certificate, logger logger.Logger, getToken func() (string, error)) func() (string, string) {
+	return func() (string, string) {
+		if cert != nil {
+			return username, ""
+		}
+		token, err := getToken()
+		if err != nil {
+			logger.Errorf("cannot generate token: %s", err)
+			return "", ""
+		}
+		return username, token
+	}
+}
+
+// sasToken returns a cached SAS token, generating and caching a new one
+// if none is cached yet or the cached one is within the renew skew of
+// expiring.
+func (tr *Transport) sasToken(creds transport.Credentials, audience string) (string, error) {
+	tr.tokMu.Lock()
+	defer tr.tokMu.Unlock()
+	if tr.tok != "" && time.Now().Add(tr.tokenRenewSkewOrDefault()).Before(tr.tokExpiry) {
+		return tr.tok, nil
+	}
+	return tr.renewTokenLocked(creds, audience)
+}
+
+// renewTokenLocked generates a new SAS token and caches it.
+// tr.tokMu must be held by the caller.
+func (tr *Transport) renewTokenLocked(creds transport.Credentials, audience string) (string, error) {
+	lifetime := tr.tokenLifetime
+	if lifetime == 0 {
+		lifetime = time.Hour
+	}
+	sas, err := creds.Token(audience, lifetime)
+	if err != nil {
+		return "", err
+	}
+	tr.tok = sas.String()
+	tr.tokExpiry = time.Now().Add(lifetime)
+	return tr.tok, nil
+}
+
+func (tr *Transport) tokenRenewSkewOrDefault() time.Duration {
+	if tr.tokenRenewSkew == 0 {
+		return 5 * time.Minute
+	}
+	return tr.tokenRenewSkew
+}
+
+// refreshTokenLoop proactively renews the cached SAS token before it
+// expires and forces a graceful reconnect so the broker never sees an
+// expired token, avoiding the reconnect-time regeneration that an
+// external token provider can make slow.
+func (tr *Transport) refreshTokenLoop(creds transport.Credentials, audience string) {
+	for {
+		tr.tokMu.Lock()
+		expiry := tr.tokExpiry
+		tr.tokMu.Unlock()
+
+		wait := time.Until(expiry) - tr.tokenRenewSkewOrDefault()
+		if wait < 0 {
+			wait = 0
+		}
+		select {
+		case <-time.After(wait):
+		case <-tr.done:
+			return
+		}
+
+		tr.tokMu.Lock()
+		_, err := tr.renewTokenLocked(creds, audience)
+		tr.tokMu.Unlock()
+		if err != nil {
+			tr.logger.Errorf("cannot renew token: %s", err)
+			select {
+			case <-time.After(time.Minute):
+				continue
+			case <-tr.done:
+				return
+			}
+		}
+
+		if tr.tokenRefreshJitter > 0 {
+			select {
+			case <-time.After(time.Duration(rand.Int63n(int64(tr.tokenRefreshJitter)))):
+			case <-tr.done:
+				return
+			}
+		}
+
+		tr.mu.RLock()
+		c := tr.conn
+		tr.mu.RUnlock()
+		if c == nil {
+			return
+		}
+
+		tr.logger.Debugf("reconnecting to apply renewed token")
+		c.Disconnect(250)
+		if err := contextToken(doneContext(tr.done), c.Connect()); err != nil {
+			tr.logger.Errorf("reconnect after token renewal failed: %s", err)
+		}
+	}
+}
+
+// renderTopic fills in the {device}/{module} placeholders of tpl and
+// prepends the configured topic prefix, if any.
+func (tr *Transport) renderTopic(tpl string) string {
+	t := strings.NewReplacer("{device}", tr.did, "{module}", tr.mid).Replace(tpl)
+	return tr.topicPrefix + t
+}
+
+// stripPrefix removes the configured topic prefix from an incoming
+// topic name before it's handed to a topic parser, which otherwise
+// wouldn't recognize the prefixed topic as its own.
+func (tr *Transport) stripPrefix(topic string) string {
+	if tr.topicPrefix == "" {
+		return topic
+	}
+	return strings.TrimPrefix(topic, tr.topicPrefix)
+}
+
 type subFunc func() error
 
 // sub invokes the given sub function and if it passes with no error,
@@ -201,8 +551,8 @@ func (tr *Transport) SubscribeEvents(ctx context.Context, mux transport.MessageD
 func (tr *Transport) subEvents(ctx context.Context, mux transport.MessageDispatcher) subFunc {
 	return func() error {
 		return contextToken(ctx, tr.conn.Subscribe(
-			"devices/"+tr.did+"/modules/"+tr.mid+"/inputs/#", DefaultQoS, func(_ mqtt.Client, m mqtt.Message) {
-				msg, err := parseEventMessage(m)
+			tr.renderTopic(tr.topics.Inputs), DefaultQoS, func(_ mqtt.Client, m mqtt.Message) {
+				msg, err := parseEventMessage(tr.stripPrefix(m.Topic()), m.Payload())
 				if err != nil {
 					tr.logger.Errorf("message parse error: %s", err)
 					return
@@ -220,20 +570,20 @@ func (tr *Transport) SubscribeTwinUpdates(ctx context.Context, mux transport.Twi
 func (tr *Transport) subTwinUpdates(ctx context.Context, mux transport.TwinStateDispatcher) subFunc {
 	return func() error {
 		return contextToken(ctx, tr.conn.Subscribe(
-			"$iothub/twin/PATCH/properties/desired/#", DefaultQoS, func(_ mqtt.Client, m mqtt.Message) {
+			tr.renderTopic(tr.topics.TwinUpdates), DefaultQoS, func(_ mqtt.Client, m mqtt.Message) {
 				mux.Dispatch(m.Payload())
 			},
 		))
 	}
 }
 
-func parseEventMessage(m mqtt.Message) (*common.Message, error) {
-	p, err := parseCloudToDeviceTopic(m.Topic())
+func parseEventMessage(topic string, payload []byte) (*common.Message, error) {
+	p, err := parseCloudToDeviceTopic(topic)
 	if err != nil {
 		return nil, err
 	}
 	e := &common.Message{
-		Payload:    m.Payload(),
+		Payload:    payload,
 		Properties: make(map[string]string, len(p)),
 	}
 	for k, v := range p {
@@ -294,8 +644,8 @@ func (tr *Transport) RegisterDirectMethods(ctx context.Context, mux transport.Me
 func (tr *Transport) subDirectMethods(ctx context.Context, mux transport.MethodDispatcher) subFunc {
 	return func() error {
 		return contextToken(ctx, tr.conn.Subscribe(
-			"$iothub/methods/POST/#", DefaultQoS, func(_ mqtt.Client, m mqtt.Message) {
-				method, rid, err := parseDirectMethodTopic(m.Topic())
+			tr.renderTopic(tr.topics.DirectMethods), DefaultQoS, func(_ mqtt.Client, m mqtt.Message) {
+				method, rid, err := parseDirectMethodTopic(tr.stripPrefix(m.Topic()))
 				if err != nil {
 					tr.logger.Errorf("parse error: %s", err)
 					return
@@ -305,7 +655,7 @@ func (tr *Transport) subDirectMethods(ctx context.Context, mux transport.MethodD
 					tr.logger.Errorf("dispatch error: %s", err)
 					return
 				}
-				dst := fmt.Sprintf("$iothub/methods/res/%d/?$rid=%d", rc, rid)
+				dst := tr.renderTopic(fmt.Sprintf(tr.topics.DirectMethodResponse, rc, rid))
 				if err = tr.send(ctx, dst, DefaultQoS, b); err != nil {
 					tr.logger.Errorf("method response error: %s", err)
 					return
@@ -346,7 +696,7 @@ func parseDirectMethodTopic(s string) (string, int, error) {
 }
 
 func (tr *Transport) RetrieveTwinProperties(ctx context.Context) ([]byte, error) {
-	r, err := tr.request(ctx, "$iothub/twin/GET/?$rid=%d", nil)
+	r, err := tr.request(ctx, tr.enableTwinResponses, tr.topics.TwinGet, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -354,19 +704,137 @@ func (tr *Transport) RetrieveTwinProperties(ctx context.Context) ([]byte, error)
 }
 
 func (tr *Transport) UpdateTwinProperties(ctx context.Context, b []byte) (int, error) {
-	r, err := tr.request(ctx, "$iothub/twin/PATCH/properties/reported/?$rid=%d", b)
+	r, err := tr.request(ctx, tr.enableTwinResponses, tr.topics.TwinPatch, b)
 	if err != nil {
 		return 0, err
 	}
 	return r.ver, nil
 }
 
-func (tr *Transport) request(ctx context.Context, topic string, b []byte) (*resp, error) {
-	if err := tr.enableTwinResponses(ctx); err != nil {
+// FileUploadInfo is the SAS URI information returned by
+// RequestFileUploadURI, describing where to HTTPS PUT the file being
+// uploaded and the correlation ID to echo back to NotifyFileUpload. The
+// JSON shape matches IoT Hub's real (HTTPS) file upload API.
+type FileUploadInfo struct {
+	CorrelationID string `json:"correlationId"`
+	HostName      string `json:"hostName"`
+	ContainerName string `json:"containerName"`
+	BlobName      string `json:"blobName"`
+	SasToken      string `json:"sasToken"`
+}
+
+// BlobURI returns the full HTTPS URI the file contents must be PUT to.
+func (i *FileUploadInfo) BlobURI() string {
+	return fmt.Sprintf("https://%s/%s/%s%s", i.HostName, i.ContainerName, i.BlobName, i.SasToken)
+}
+
+// RequestFileUploadURI asks IoT Hub for a blob SAS URI to upload
+// blobName to, e.g. for shipping logs or firmware dumps collected by the
+// module. File upload is one of the few IoT Hub operations that's
+// HTTPS-only, with no MQTT equivalent, so this calls
+// POST /devices/{deviceId}/files directly instead of going through
+// tr.request; authentication reuses the SAS token or client certificate
+// Connect already set up. Use common.UploadFile to PUT the file contents
+// to the returned FileUploadInfo.BlobURI, then NotifyFileUpload to
+// report completion.
+func (tr *Transport) RequestFileUploadURI(ctx context.Context, blobName string) (*FileUploadInfo, error) {
+	b, err := json.Marshal(&struct {
+		BlobName string `json:"blobName"`
+	}{BlobName: blobName})
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := tr.fileUploadRequest(ctx, fmt.Sprintf("/devices/%s/files", url.PathEscape(tr.did)), b)
+	if err != nil {
+		return nil, err
+	}
+	info := &FileUploadInfo{}
+	if err := json.Unmarshal(res, info); err != nil {
+		return nil, fmt.Errorf("cannot parse file upload response: %s", err)
+	}
+	return info, nil
+}
+
+// NotifyFileUpload tells IoT Hub that the upload identified by
+// correlationID (as returned in FileUploadInfo.CorrelationID) finished,
+// successfully or not, via POST /devices/{deviceId}/files/notifications.
+// See RequestFileUploadURI for why this bypasses MQTT.
+func (tr *Transport) NotifyFileUpload(ctx context.Context, correlationID string, success bool, statusCode int, statusDescription string) error {
+	b, err := json.Marshal(&struct {
+		CorrelationID     string `json:"correlationId"`
+		IsSuccess         bool   `json:"isSuccess"`
+		StatusCode        int    `json:"statusCode"`
+		StatusDescription string `json:"statusDescription"`
+	}{
+		CorrelationID:     correlationID,
+		IsSuccess:         success,
+		StatusCode:        statusCode,
+		StatusDescription: statusDescription,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tr.fileUploadRequest(ctx, fmt.Sprintf("/devices/%s/files/notifications", url.PathEscape(tr.did)), b)
+	return err
+}
+
+// fileUploadRequest POSTs body to path against the file-upload REST API
+// (https://{hub}, or fileUploadBaseURL when overridden for tests),
+// authenticating the same way Connect's MQTT connection does: a cached
+// SAS token in the Authorization header, or nothing extra when creds
+// supplied a client certificate, since tr.httpClient's TLS config already
+// presents it.
+func (tr *Transport) fileUploadRequest(ctx context.Context, path string, body []byte) ([]byte, error) {
+	base := tr.fileUploadBaseURL
+	if base == "" {
+		base = "https://" + tr.creds.GetHostName()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+path+"?api-version="+fileUploadAPIVersion, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if tr.creds.GetCertificate() == nil {
+		token, err := tr.sasToken(tr.creds, url.QueryEscape(tr.creds.GetHostName()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", token)
+	}
+
+	res, err := tr.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, fmt.Errorf("file upload request failed with %d response code", res.StatusCode)
+	}
+	return resBody, nil
+}
+
+// request performs a $rid-correlated request/response round-trip: it
+// makes sure the relevant response topic is subscribed to (via enable),
+// publishes b to topic with the assigned $rid filled in, and waits for
+// the matching entry in tr.resp.
+//
+// This bypasses the outbox on purpose: a request/response call has no
+// sensible "queued" outcome, since whatever outbox-flushing publish
+// finally succeeds would reuse an $rid whose tr.resp entry has long been
+// cleaned up here, so any real response for it is dropped as an
+// "unknown rid". Callers get a plain connectivity error instead and
+// decide for themselves whether to retry.
+func (tr *Transport) request(ctx context.Context, enable func(context.Context) error, topic string, b []byte) (*resp, error) {
+	if err := enable(ctx); err != nil {
 		return nil, err
 	}
 	rid := atomic.AddUint32(&tr.rid, 1) // increment rid counter
-	dst := fmt.Sprintf(topic, rid)
+	dst := tr.renderTopic(fmt.Sprintf(topic, rid))
 	rch := make(chan *resp, 1)
 	tr.mu.Lock()
 	tr.resp[rid] = rch
@@ -377,13 +845,13 @@ func (tr *Transport) request(ctx context.Context, topic string, b []byte) (*resp
 		tr.mu.Unlock()
 	}()
 
-	if err := tr.send(ctx, dst, DefaultQoS, b); err != nil {
+	if err := tr.publish(ctx, dst, DefaultQoS, false, b); err != nil {
 		return nil, err
 	}
 
 	select {
 	case r := <-rch:
-		if r.code < 200 && r.code > 299 {
+		if r.code < 200 || r.code > 299 {
 			return nil, fmt.Errorf("request failed with %d response code", r.code)
 		}
 		return r, nil
@@ -396,22 +864,25 @@ func (tr *Transport) enableTwinResponses(ctx context.Context) error {
 	tr.mu.Lock()
 	defer tr.mu.Unlock()
 
+	if tr.resp == nil {
+		tr.resp = make(map[uint32]chan *resp)
+	}
 	// already subscribed
-	if tr.resp != nil {
+	if tr.twinRespSubbed {
 		return nil
 	}
 	if err := tr.sub(tr.subTwinResponses(ctx)); err != nil {
 		return err
 	}
-	tr.resp = make(map[uint32]chan *resp)
+	tr.twinRespSubbed = true
 	return nil
 }
 
 func (tr *Transport) subTwinResponses(ctx context.Context) subFunc {
 	return func() error {
 		return contextToken(ctx, tr.conn.Subscribe(
-			"$iothub/twin/res/#", DefaultQoS, func(_ mqtt.Client, m mqtt.Message) {
-				rc, rid, ver, err := parseTwinPropsTopic(m.Topic())
+			tr.renderTopic(tr.topics.TwinResponse), DefaultQoS, func(_ mqtt.Client, m mqtt.Message) {
+				rc, rid, ver, err := parseTwinPropsTopic(tr.stripPrefix(m.Topic()))
 				if err != nil {
 					fmt.Printf("parse twin props topic error: %s", err)
 					return
@@ -503,7 +974,7 @@ func (tr *Transport) Send(ctx context.Context, msg *common.Message) error {
 		u[k] = []string{v}
 	}
 
-	dst := "devices/" + tr.did + "/modules/" + tr.mid + "/messages/events/" + u.Encode()
+	dst := tr.renderTopic(tr.topics.Events) + u.Encode()
 	tr.logger.Warnf("send message destination: %s", dst)
 	qos := DefaultQoS
 	if q, ok := msg.TransportOptions["qos"]; ok {
@@ -515,14 +986,126 @@ func (tr *Transport) Send(ctx context.Context, msg *common.Message) error {
 	return tr.send(ctx, dst, qos, msg.Payload)
 }
 
+// PublishState publishes payload to the state topic configured via
+// WithStateTopicTemplate (or the default), optionally as a retained
+// message so the broker always serves the last known state to new
+// subscribers.
+func (tr *Transport) PublishState(ctx context.Context, payload []byte, retained bool) error {
+	return tr.sendRetained(ctx, tr.renderTopic(tr.topics.State), DefaultQoS, retained, payload)
+}
+
 func (tr *Transport) send(ctx context.Context, topic string, qos int, b []byte) error {
+	return tr.sendRetained(ctx, topic, qos, false, b)
+}
+
+// publish is the bare MQTT publish, with no outbox fallback: it's used
+// by request/response calls (see request), which have no sensible way
+// to handle a publish that was merely queued for later.
+func (tr *Transport) publish(ctx context.Context, topic string, qos int, retained bool, b []byte) error {
 	tr.mu.RLock()
-	if tr.conn == nil {
-		tr.mu.RUnlock()
+	conn := tr.conn
+	tr.mu.RUnlock()
+	if conn == nil {
 		return errors.New("not connected")
 	}
-	tr.mu.RUnlock()
-	return contextToken(ctx, tr.conn.Publish(topic, byte(qos), false, b))
+	return contextToken(ctx, conn.Publish(topic, byte(qos), retained, b))
+}
+
+// sendRetained publishes b to topic for the one-way, fire-and-forget
+// paths (Send, PublishState). If the publish fails and an outbox is
+// configured via WithOutbox, it's queued instead of failing outright.
+func (tr *Transport) sendRetained(ctx context.Context, topic string, qos int, retained bool, b []byte) error {
+	err := tr.publish(ctx, topic, qos, retained, b)
+	if err == nil {
+		return nil
+	}
+	return tr.enqueue(topic, qos, retained, b, err)
+}
+
+// enqueue stores a publish in the outbox in place of failing with cause,
+// when that's possible: only QoS 1, non-retained publishes within
+// outboxMaxBytes are eligible for queuing.
+func (tr *Transport) enqueue(topic string, qos int, retained bool, b []byte, cause error) error {
+	if tr.outbox == nil || qos != DefaultQoS || retained {
+		return cause
+	}
+	if tr.outboxMaxBytes > 0 && int64(len(b)) > tr.outboxMaxBytes {
+		return cause
+	}
+	if err := tr.outbox.Enqueue(&store.Message{Topic: topic, QoS: byte(qos), Payload: b}); err != nil {
+		tr.logger.Errorf("outbox enqueue error: %s", err)
+		return cause
+	}
+	tr.logger.Debugf("queued publish to %q in outbox", topic)
+	return nil
+}
+
+// drainOutbox flushes queued publishes in FIFO order over conn once the
+// connection is (re-)established. It stops at the first error, leaving
+// the rest of the queue for the next successful connection. conn is the
+// client passed into the on-connect handler, not tr.conn, since this
+// runs before tr.conn is assigned on the very first connect.
+//
+// Only one drain runs at a time (CAS-guarded by tr.draining): every
+// reconnect fires the on-connect handler, and without this guard a slow
+// drain from a previous connection could overlap with a new one and
+// dequeue-publish-ack the same message twice.
+func (tr *Transport) drainOutbox(conn mqtt.Client) {
+	if !atomic.CompareAndSwapInt32(&tr.draining, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&tr.draining, 0)
+
+	for {
+		select {
+		case <-tr.done:
+			return
+		default:
+		}
+
+		if !conn.IsConnected() {
+			return
+		}
+
+		msg, err := tr.outbox.Dequeue()
+		if err != nil {
+			if err != store.ErrEmpty {
+				tr.logger.Errorf("outbox dequeue error: %s", err)
+			}
+			return
+		}
+
+		if err := contextToken(doneContext(tr.done), conn.Publish(msg.Topic, msg.QoS, false, msg.Payload)); err != nil {
+			tr.logger.Errorf("outbox drain publish error: %s", err)
+			return
+		}
+		if err := tr.outbox.Ack(msg.ID); err != nil {
+			tr.logger.Errorf("outbox ack error: %s", err)
+			return
+		}
+	}
+}
+
+// doneContext adapts a "closed when done" channel, such as Transport.done,
+// into a context.Context so it can be passed to contextToken: this keeps
+// the token-waiting goroutine from outliving Close() when there's no
+// caller-supplied context to cancel it (e.g. the background reconnect in
+// refreshTokenLoop and the outbox drain loop).
+type doneContext chan struct{}
+
+func (d doneContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (d doneContext) Done() <-chan struct{}       { return d }
+func (d doneContext) Value(interface{}) interface{} {
+	return nil
+}
+
+func (d doneContext) Err() error {
+	select {
+	case <-d:
+		return context.Canceled
+	default:
+		return nil
+	}
 }
 
 // mqtt lib doesn't support contexts currently
@@ -0,0 +1,248 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/iothub/iotmodule/transport"
+	"github.com/amenzhinsky/iothub/logger"
+)
+
+// nopLogger discards every message, so tests that exercise logging
+// paths don't need to assert on log output, just that nothing panics.
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{}) {}
+func (nopLogger) Warnf(string, ...interface{})  {}
+func (nopLogger) Errorf(string, ...interface{}) {}
+
+var _ logger.Logger = nopLogger{}
+
+func TestRenderTopic(t *testing.T) {
+	tr := &Transport{did: "dev1", mid: "mod1"}
+	got := tr.renderTopic("devices/{device}/modules/{module}/messages/events/")
+	want := "devices/dev1/modules/mod1/messages/events/"
+	if got != want {
+		t.Errorf("renderTopic() = %q, want %q", got, want)
+	}
+}
+
+func TestRenderTopicWithPrefix(t *testing.T) {
+	tr := &Transport{did: "dev1", mid: "mod1", topicPrefix: "relay/"}
+	got := tr.renderTopic("devices/{device}/modules/{module}/state")
+	want := "relay/devices/dev1/modules/mod1/state"
+	if got != want {
+		t.Errorf("renderTopic() = %q, want %q", got, want)
+	}
+}
+
+func TestStripPrefix(t *testing.T) {
+	tr := &Transport{topicPrefix: "relay/"}
+	got := tr.stripPrefix("relay/devices/dev1/modules/mod1/state")
+	want := "devices/dev1/modules/mod1/state"
+	if got != want {
+		t.Errorf("stripPrefix() = %q, want %q", got, want)
+	}
+}
+
+func TestStripPrefixNoPrefixConfigured(t *testing.T) {
+	tr := &Transport{}
+	topic := "devices/dev1/modules/mod1/state"
+	if got := tr.stripPrefix(topic); got != topic {
+		t.Errorf("stripPrefix() = %q, want %q", got, topic)
+	}
+}
+
+func TestBrokerURL(t *testing.T) {
+	tests := []struct {
+		name   string
+		scheme string
+		port   int
+		host   string
+		want   string
+	}{
+		{"default scheme and port", "", 0, "myhub.azure-devices.net", "tls://myhub.azure-devices.net:8883"},
+		{"explicit tls port", "tls", 1883, "myhub.azure-devices.net", "tls://myhub.azure-devices.net:1883"},
+		{"ws default port and mqtt path", "ws", 0, "myhub.azure-devices.net", "ws://myhub.azure-devices.net:80/mqtt"},
+		{"wss default port and mqtt path", "wss", 0, "myhub.azure-devices.net", "wss://myhub.azure-devices.net:443/mqtt"},
+		{"wss explicit port", "wss", 8443, "myhub.azure-devices.net", "wss://myhub.azure-devices.net:8443/mqtt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := brokerURL(tt.scheme, tt.port, tt.host); got != tt.want {
+				t.Errorf("brokerURL(%q, %d, %q) = %q, want %q", tt.scheme, tt.port, tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCredentialsProviderWithCertificate(t *testing.T) {
+	cert := &tls.Certificate{}
+	provider := credentialsProvider("user", cert, nopLogger{}, func() (string, error) {
+		t.Fatal("getToken should not be called when a certificate is present")
+		return "", nil
+	})
+	user, pass := provider()
+	if user != "user" || pass != "" {
+		t.Errorf("provider() = (%q, %q), want (\"user\", \"\")", user, pass)
+	}
+}
+
+func TestCredentialsProviderWithSASToken(t *testing.T) {
+	provider := credentialsProvider("user", nil, nopLogger{}, func() (string, error) {
+		return "sas-token", nil
+	})
+	user, pass := provider()
+	if user != "user" || pass != "sas-token" {
+		t.Errorf("provider() = (%q, %q), want (\"user\", \"sas-token\")", user, pass)
+	}
+}
+
+func TestCredentialsProviderTokenError(t *testing.T) {
+	provider := credentialsProvider("user", nil, nopLogger{}, func() (string, error) {
+		return "", errors.New("token generation failed")
+	})
+	user, pass := provider()
+	if user != "" || pass != "" {
+		t.Errorf("provider() = (%q, %q), want (\"\", \"\") on token error", user, pass)
+	}
+}
+
+// fakeSAS is a transport.SharedAccessSignature that renders as a fixed
+// string, enough for the file-upload tests to assert an Authorization
+// header was sent.
+type fakeSAS string
+
+func (s fakeSAS) String() string { return string(s) }
+
+// fakeCreds is a minimal transport.Credentials for exercising the
+// file-upload HTTPS calls without a real IoT Hub connection.
+type fakeCreds struct {
+	hostName string
+	cert     *tls.Certificate
+}
+
+func (c fakeCreds) GetHostName() string              { return c.hostName }
+func (c fakeCreds) GetDeviceID() string              { return "dev1" }
+func (c fakeCreds) GetModuleID() string              { return "mod1" }
+func (c fakeCreds) GetGenerationID() string          { return "" }
+func (c fakeCreds) GetBroker() string                { return c.hostName }
+func (c fakeCreds) GetCertificate() *tls.Certificate { return c.cert }
+func (c fakeCreds) UseEdgeGateway() bool             { return false }
+func (c fakeCreds) Token(string, time.Duration) (transport.SharedAccessSignature, error) {
+	return fakeSAS("sas-token"), nil
+}
+
+var _ transport.Credentials = fakeCreds{}
+
+func TestRequestFileUploadURI(t *testing.T) {
+	var gotPath, gotAuth, gotBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotAuth = r.Header.Get("Authorization")
+		body := make([]byte, r.ContentLength)
+		r.Body.Read(body)
+		gotBody = string(body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"correlationId":"cid1","hostName":"blob.example.com","containerName":"c1","blobName":"b1","sasToken":"?sig=abc"}`))
+	}))
+	defer srv.Close()
+
+	tr := &Transport{
+		did:               "dev1",
+		creds:             fakeCreds{hostName: "myhub.azure-devices.net"},
+		httpClient:        srv.Client(),
+		fileUploadBaseURL: srv.URL,
+	}
+	info, err := tr.RequestFileUploadURI(context.Background(), "b1")
+	if err != nil {
+		t.Fatalf("RequestFileUploadURI() error = %s", err)
+	}
+	if gotPath != "/devices/dev1/files" {
+		t.Errorf("request path = %q, want %q", gotPath, "/devices/dev1/files")
+	}
+	if gotAuth != "sas-token" {
+		t.Errorf("Authorization header = %q, want %q", gotAuth, "sas-token")
+	}
+	if gotBody != `{"blobName":"b1"}` {
+		t.Errorf("request body = %q, want %q", gotBody, `{"blobName":"b1"}`)
+	}
+	want := &FileUploadInfo{CorrelationID: "cid1", HostName: "blob.example.com", ContainerName: "c1", BlobName: "b1", SasToken: "?sig=abc"}
+	if *info != *want {
+		t.Errorf("RequestFileUploadURI() = %+v, want %+v", info, want)
+	}
+}
+
+func TestRequestFileUploadURIWithCertificateSendsNoAuthHeader(t *testing.T) {
+	var gotAuth string
+	var sawAuth bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth, sawAuth = r.Header.Get("Authorization"), r.Header.Get("Authorization") != ""
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	tr := &Transport{
+		did:               "dev1",
+		creds:             fakeCreds{hostName: "myhub.azure-devices.net", cert: &tls.Certificate{}},
+		httpClient:        srv.Client(),
+		fileUploadBaseURL: srv.URL,
+	}
+	if _, err := tr.RequestFileUploadURI(context.Background(), "b1"); err != nil {
+		t.Fatalf("RequestFileUploadURI() error = %s", err)
+	}
+	if sawAuth {
+		t.Errorf("Authorization header = %q, want none when authenticating via client certificate", gotAuth)
+	}
+}
+
+func TestNotifyFileUpload(t *testing.T) {
+	var gotPath, gotBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		body := make([]byte, r.ContentLength)
+		r.Body.Read(body)
+		gotBody = string(body)
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	tr := &Transport{
+		did:               "dev1",
+		creds:             fakeCreds{hostName: "myhub.azure-devices.net"},
+		httpClient:        srv.Client(),
+		fileUploadBaseURL: srv.URL,
+	}
+	if err := tr.NotifyFileUpload(context.Background(), "cid1", true, 200, "OK"); err != nil {
+		t.Fatalf("NotifyFileUpload() error = %s", err)
+	}
+	if gotPath != "/devices/dev1/files/notifications" {
+		t.Errorf("request path = %q, want %q", gotPath, "/devices/dev1/files/notifications")
+	}
+	want := `{"correlationId":"cid1","isSuccess":true,"statusCode":200,"statusDescription":"OK"}`
+	if gotBody != want {
+		t.Errorf("request body = %q, want %q", gotBody, want)
+	}
+}
+
+func TestFileUploadRequestErrorOnNonSuccessStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	tr := &Transport{
+		did:               "dev1",
+		creds:             fakeCreds{hostName: "myhub.azure-devices.net"},
+		httpClient:        srv.Client(),
+		fileUploadBaseURL: srv.URL,
+	}
+	if _, err := tr.RequestFileUploadURI(context.Background(), "b1"); err == nil {
+		t.Fatal("RequestFileUploadURI() error = nil, want an error on a 401 response")
+	}
+}
@@ -0,0 +1,119 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+
+	"go.etcd.io/bbolt"
+)
+
+var outboxBucket = []byte("outbox")
+
+// BoltStore is a durable Store backed by a BoltDB file, so queued
+// messages survive a process restart.
+type BoltStore struct {
+	db *bbolt.DB
+
+	mu     sync.Mutex
+	leased *uint64
+}
+
+// OpenBoltStore opens (creating if necessary) a BoltDB-backed Store at path.
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bbolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(outboxBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+// Close closes the underlying BoltDB file.
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltStore) Enqueue(msg *Message) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(outboxBucket)
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		msg.ID = id
+		v, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		return b.Put(itob(id), v)
+	})
+}
+
+// Dequeue claims the oldest unacknowledged message and keeps returning
+// that same message to subsequent callers until it's Ack'd, instead of
+// handing the head of the queue to every caller that asks. Two drain
+// loops calling Dequeue concurrently therefore both get the leased
+// message, and neither gets the next one until it's Ack'd, so FIFO order
+// holds.
+func (s *BoltStore) Dequeue() (*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.leased != nil {
+		return s.get(*s.leased)
+	}
+	var msg *Message
+	if err := s.db.View(func(tx *bbolt.Tx) error {
+		k, v := tx.Bucket(outboxBucket).Cursor().First()
+		if k == nil {
+			return ErrEmpty
+		}
+		msg = &Message{}
+		return json.Unmarshal(v, msg)
+	}); err != nil {
+		return nil, err
+	}
+	s.leased = &msg.ID
+	return msg, nil
+}
+
+func (s *BoltStore) get(id uint64) (*Message, error) {
+	var msg *Message
+	if err := s.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(outboxBucket).Get(itob(id))
+		if v == nil {
+			return ErrEmpty
+		}
+		msg = &Message{}
+		return json.Unmarshal(v, msg)
+	}); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (s *BoltStore) Ack(id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(outboxBucket).Delete(itob(id))
+	}); err != nil {
+		return err
+	}
+	if s.leased != nil && *s.leased == id {
+		s.leased = nil
+	}
+	return nil
+}
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
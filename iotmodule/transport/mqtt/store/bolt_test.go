@@ -0,0 +1,48 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestBoltStoreFIFOAndDequeueClaim(t *testing.T) {
+	s, err := OpenBoltStore(filepath.Join(t.TempDir(), "outbox.db"))
+	if err != nil {
+		t.Fatalf("OpenBoltStore(): %s", err)
+	}
+	defer s.Close()
+
+	for _, topic := range []string{"a", "b"} {
+		if err := s.Enqueue(&Message{Topic: topic}); err != nil {
+			t.Fatalf("Enqueue(%q): %s", topic, err)
+		}
+	}
+
+	first, err := s.Dequeue()
+	if err != nil {
+		t.Fatalf("Dequeue(): %s", err)
+	}
+	if first.Topic != "a" {
+		t.Fatalf("Dequeue().Topic = %q, want %q", first.Topic, "a")
+	}
+
+	again, err := s.Dequeue()
+	if err != nil {
+		t.Fatalf("Dequeue(): %s", err)
+	}
+	if again.ID != first.ID {
+		t.Fatalf("Dequeue() returned ID %d while %d is in flight, want the same message", again.ID, first.ID)
+	}
+
+	if err := s.Ack(first.ID); err != nil {
+		t.Fatalf("Ack(%d): %s", first.ID, err)
+	}
+
+	next, err := s.Dequeue()
+	if err != nil {
+		t.Fatalf("Dequeue(): %s", err)
+	}
+	if next.Topic != "b" {
+		t.Fatalf("Dequeue().Topic = %q, want %q", next.Topic, "b")
+	}
+}
@@ -0,0 +1,87 @@
+// Package store provides durable store-and-forward queues for MQTT
+// publishes made while the transport is disconnected from the broker.
+package store
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrEmpty is returned by Store.Dequeue when there are no queued messages.
+var ErrEmpty = errors.New("store: empty")
+
+// Message is a single queued MQTT publish awaiting delivery.
+type Message struct {
+	ID      uint64
+	Topic   string
+	QoS     byte
+	Payload []byte
+}
+
+// Store persists messages that couldn't be published immediately so they
+// can be retried once the connection to the broker is restored. Only QoS
+// 1 publishes are eligible for queuing, since QoS 0 has no delivery
+// guarantee worth persisting.
+type Store interface {
+	// Enqueue appends msg to the store, assigning it an ID.
+	Enqueue(msg *Message) error
+
+	// Dequeue returns the oldest unacknowledged message in FIFO order,
+	// or ErrEmpty if the store currently has none.
+	Dequeue() (*Message, error)
+
+	// Ack removes the message with the given ID from the store once
+	// it's been successfully published.
+	Ack(id uint64) error
+}
+
+// MemoryStore is an in-memory Store. Queued messages do not survive a
+// process restart; use store.BoltStore for that.
+type MemoryStore struct {
+	mu       sync.Mutex
+	next     uint64
+	msgs     []*Message
+	inFlight *Message
+}
+
+// NewMemoryStore returns an empty in-memory Store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+func (s *MemoryStore) Enqueue(msg *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next++
+	msg.ID = s.next
+	s.msgs = append(s.msgs, msg)
+	return nil
+}
+
+// Dequeue claims the oldest unacknowledged message and keeps returning
+// that same message to subsequent callers until it's Ack'd, instead of
+// handing the head of the queue to every caller that asks. Two drain
+// loops calling Dequeue concurrently therefore both get the in-flight
+// message, and neither gets the next one until it's Ack'd, so FIFO order
+// holds.
+func (s *MemoryStore) Dequeue() (*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inFlight != nil {
+		return s.inFlight, nil
+	}
+	if len(s.msgs) == 0 {
+		return nil, ErrEmpty
+	}
+	s.inFlight, s.msgs = s.msgs[0], s.msgs[1:]
+	return s.inFlight, nil
+}
+
+func (s *MemoryStore) Ack(id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inFlight != nil && s.inFlight.ID == id {
+		s.inFlight = nil
+	}
+	return nil
+}
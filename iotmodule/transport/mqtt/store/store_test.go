@@ -0,0 +1,74 @@
+package store
+
+import "testing"
+
+func TestMemoryStoreFIFO(t *testing.T) {
+	s := NewMemoryStore()
+	for _, topic := range []string{"a", "b", "c"} {
+		if err := s.Enqueue(&Message{Topic: topic}); err != nil {
+			t.Fatalf("Enqueue(%q): %s", topic, err)
+		}
+	}
+	for _, want := range []string{"a", "b", "c"} {
+		msg, err := s.Dequeue()
+		if err != nil {
+			t.Fatalf("Dequeue(): %s", err)
+		}
+		if msg.Topic != want {
+			t.Fatalf("Dequeue().Topic = %q, want %q", msg.Topic, want)
+		}
+		if err := s.Ack(msg.ID); err != nil {
+			t.Fatalf("Ack(%d): %s", msg.ID, err)
+		}
+	}
+	if _, err := s.Dequeue(); err != ErrEmpty {
+		t.Fatalf("Dequeue() on empty store = %v, want ErrEmpty", err)
+	}
+}
+
+func TestMemoryStoreDequeueClaimsUntilAck(t *testing.T) {
+	s := NewMemoryStore()
+	if err := s.Enqueue(&Message{Topic: "a"}); err != nil {
+		t.Fatalf("Enqueue(): %s", err)
+	}
+	if err := s.Enqueue(&Message{Topic: "b"}); err != nil {
+		t.Fatalf("Enqueue(): %s", err)
+	}
+
+	first, err := s.Dequeue()
+	if err != nil {
+		t.Fatalf("Dequeue(): %s", err)
+	}
+	if first.Topic != "a" {
+		t.Fatalf("Dequeue().Topic = %q, want %q", first.Topic, "a")
+	}
+
+	// A second, concurrent Dequeue (e.g. from an overlapping drain) must
+	// see the same in-flight message, not "b", until it's Ack'd.
+	again, err := s.Dequeue()
+	if err != nil {
+		t.Fatalf("Dequeue(): %s", err)
+	}
+	if again.ID != first.ID {
+		t.Fatalf("Dequeue() returned ID %d while %d is in flight, want the same message", again.ID, first.ID)
+	}
+
+	if err := s.Ack(first.ID); err != nil {
+		t.Fatalf("Ack(%d): %s", first.ID, err)
+	}
+
+	next, err := s.Dequeue()
+	if err != nil {
+		t.Fatalf("Dequeue(): %s", err)
+	}
+	if next.Topic != "b" {
+		t.Fatalf("Dequeue().Topic = %q, want %q", next.Topic, "b")
+	}
+}
+
+func TestMemoryStoreAckUnknownID(t *testing.T) {
+	s := NewMemoryStore()
+	if err := s.Ack(999); err != nil {
+		t.Fatalf("Ack() of unknown id = %s, want nil", err)
+	}
+}